@@ -0,0 +1,395 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// BridgeAgingTimeout is the default duration a learned MAC address table
+// entry is kept before it is evicted.
+const BridgeAgingTimeout = 5 * time.Minute
+
+type bridgeEntry struct {
+	nic  tcpip.NICID
+	seen time.Time
+}
+
+// Bridge binds multiple [Interface] members together at L2: a frame
+// received on one member is forwarded to the member behind which its
+// destination MAC was last learned, or flooded to every other member (and
+// the bridge itself) when the destination is unknown, broadcast or
+// multicast.
+//
+// A Bridge also registers its own virtual NIC (the BVI, Bridge Virtual
+// Interface) on the shared Stack, so that the host can terminate TCP/IP
+// directly on the bridge, see Addr.
+type Bridge struct {
+	// NICID is the identifier of the bridge's own virtual NIC (BVI).
+	NICID tcpip.NICID
+	// Stack is the gVisor Stack shared by the bridge and its members.
+	Stack *stack.Stack
+	// Aging is the duration after which a learned table entry expires, it
+	// defaults to BridgeAgingTimeout when zero.
+	Aging time.Duration
+
+	bvi *channel.Endpoint
+
+	mu      sync.Mutex
+	members map[tcpip.NICID]*Interface
+	table   map[tcpip.LinkAddress]bridgeEntry
+}
+
+// NewBridge creates a Bridge on s, registering its BVI under nicID with mac
+// as its link address (a random one is used if mac is empty).
+func NewBridge(s *stack.Stack, nicID tcpip.NICID, mac string) (br *Bridge, err error) {
+	var laddr net.HardwareAddr
+
+	if len(mac) == 0 {
+		laddr = randomMAC()
+	} else {
+		if laddr, err = net.ParseMAC(mac); err != nil {
+			return nil, err
+		}
+	}
+
+	linkAddr, err := tcpip.ParseMACAddress(laddr.String())
+
+	if err != nil {
+		return nil, err
+	}
+
+	br = &Bridge{
+		NICID:   nicID,
+		Stack:   s,
+		Aging:   BridgeAgingTimeout,
+		bvi:     channel.New(256, MTU, linkAddr),
+		members: make(map[tcpip.NICID]*Interface),
+		table:   make(map[tcpip.LinkAddress]bridgeEntry),
+	}
+
+	br.bvi.LinkEPCapabilities |= stack.CapabilityResolutionRequired
+
+	if err := s.CreateNIC(nicID, br.bvi); err != nil {
+		return nil, fmt.Errorf("%v", err)
+	}
+
+	go br.pump()
+
+	return br, nil
+}
+
+// AddMember registers iface as a bridge member, assigning it a unique
+// NICID if it does not already have one, and returns an error if iface is
+// already a member under its current NICID. It must be called before
+// iface.Init or iface.InitDHCP, as it installs the bridging
+// [LinkMiddleware] in the interface's Use chain and Init only allocates a
+// NICID when one has not already been set.
+func (br *Bridge) AddMember(iface *Interface) error {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if iface.NICID == 0 {
+		iface.NICID = br.allocateNICID()
+	}
+
+	if _, ok := br.members[iface.NICID]; ok {
+		return fmt.Errorf("NIC %d is already a bridge member", iface.NICID)
+	}
+
+	br.members[iface.NICID] = iface
+	iface.Use(&bridgePort{bridge: br, nicID: iface.NICID})
+
+	return nil
+}
+
+// allocateNICID returns a NICID not already in use by the bridge's BVI, any
+// of its members, or any other Interface registered on the shared Stack,
+// reusing the same allocation strategy as a plain Interface (nextNICID). A
+// NICID handed to a member is reserved only against later allocations by
+// this bridge: a plain Interface initialized on the same Stack before that
+// member's Init does not see it, and can be assigned the same NICID. br.mu
+// must be held by the caller.
+func (br *Bridge) allocateNICID() tcpip.NICID {
+	reserved := make([]tcpip.NICID, 0, len(br.members)+1)
+	reserved = append(reserved, br.NICID)
+
+	for id := range br.members {
+		reserved = append(reserved, id)
+	}
+
+	return nextNICID(br.Stack, reserved...)
+}
+
+// Addr configures host-terminated IPv4/IPv6 addresses, with matching default
+// gateways, on the bridge BVI, as Interface.Init does for a regular
+// interface.
+func (br *Bridge) Addr(addrs []string, gateways []string) error {
+	bvi := &Interface{NICID: br.NICID, Stack: br.Stack, Link: br.bvi}
+
+	ips := make([]tcpip.AddressWithPrefix, 0, len(addrs))
+
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr)
+
+		if err != nil {
+			return err
+		}
+
+		ips = append(ips, tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFromSlice(normalizeIP(ip)),
+			PrefixLen: tcpip.MaskFromBytes(ipnet.Mask).Prefix(),
+		})
+	}
+
+	gws := make([]tcpip.Address, 0, len(gateways))
+
+	for _, gateway := range gateways {
+		gwIP := net.ParseIP(gateway)
+
+		if gwIP == nil {
+			return fmt.Errorf("invalid gateway address %q", gateway)
+		}
+
+		gws = append(gws, tcpip.AddrFromSlice(normalizeIP(gwIP)))
+	}
+
+	return bvi.addAddresses(ips, gws)
+}
+
+func (br *Bridge) aging() time.Duration {
+	if br.Aging == 0 {
+		return BridgeAgingTimeout
+	}
+
+	return br.Aging
+}
+
+func (br *Bridge) learn(src tcpip.LinkAddress, nicID tcpip.NICID) {
+	if len(src) == 0 {
+		return
+	}
+
+	br.mu.Lock()
+	br.table[src] = bridgeEntry{nic: nicID, seen: time.Now()}
+	br.mu.Unlock()
+}
+
+// forward relays frame, received on (or, for host originated traffic,
+// addressed from) inNIC, to the bridge member behind which dst was last
+// learned, or to every other member when dst is unknown, broadcast or
+// multicast.
+func (br *Bridge) forward(inNIC tcpip.NICID, dst tcpip.LinkAddress, frame []byte) {
+	br.mu.Lock()
+
+	if entry, ok := br.table[dst]; ok {
+		if time.Since(entry.seen) > br.aging() {
+			delete(br.table, dst)
+		} else {
+			target := br.members[entry.nic]
+			br.mu.Unlock()
+
+			if entry.nic != inNIC && target != nil {
+				br.transmit(target, frame)
+			}
+
+			return
+		}
+	}
+
+	targets := make([]*Interface, 0, len(br.members))
+
+	for nicID, member := range br.members {
+		if nicID != inNIC {
+			targets = append(targets, member)
+		}
+	}
+
+	br.mu.Unlock()
+
+	for _, target := range targets {
+		br.transmit(target, frame)
+	}
+}
+
+// transmit injects frame onto iface's outbound queue, for its NIC driver to
+// send on the wire, preserving its original source and destination MAC.
+func (br *Bridge) transmit(iface *Interface, frame []byte) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), frame...)),
+	})
+	defer pkt.DecRef()
+
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+
+	iface.Link.WritePackets(pkts)
+}
+
+// pump relays frames written by the host stack to the BVI (e.g. a reply
+// sourced from a bridge-terminated IP address) through forward: to the
+// member behind which the destination was learned, or to every bridge member
+// when it is unknown, broadcast or multicast.
+//
+// Packets read off the BVI, like those delivered to any [channel.Endpoint],
+// carry the network-layer payload only: the BVI never receives an Ethernet
+// header of its own to relay, so one is synthesized from the link addresses
+// the stack resolved for the packet, see egressFrame.
+func (br *Bridge) pump() {
+	notify := make(chan struct{}, 1)
+
+	br.bvi.AddNotify(bridgeNotify(func() {
+		select {
+		case notify <- struct{}{}:
+		default:
+		}
+	}))
+
+	for range notify {
+		for {
+			pkt := br.bvi.Read()
+
+			if pkt == nil {
+				break
+			}
+
+			frame := br.egressFrame(pkt)
+			pkt.DecRef()
+
+			if frame == nil {
+				continue
+			}
+
+			br.forward(br.NICID, header.Ethernet(frame).DestinationAddress(), frame)
+		}
+	}
+}
+
+// egressFrame builds the Ethernet frame for pkt, a packet written by the
+// host stack to the BVI, from the source/destination link addresses the
+// stack resolved for it (pkt.EgressRoute). It returns nil when no
+// destination link address was resolved, e.g. a packet still queued behind
+// ARP/NDP resolution.
+func (br *Bridge) egressFrame(pkt *stack.PacketBuffer) []byte {
+	dst := pkt.EgressRoute.RemoteLinkAddress
+
+	if len(dst) == 0 {
+		return nil
+	}
+
+	src := pkt.EgressRoute.LocalLinkAddress
+
+	if len(src) == 0 {
+		src = br.bvi.LinkAddress()
+	}
+
+	payload := pkt.ToBuffer().Flatten()
+	frame := make([]byte, header.EthernetMinimumSize+len(payload))
+
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: src,
+		DstAddr: dst,
+		Type:    pkt.NetworkProtocolNumber,
+	})
+	copy(frame[header.EthernetMinimumSize:], payload)
+
+	return frame
+}
+
+type bridgeNotify func()
+
+func (f bridgeNotify) WriteNotify() { f() }
+
+// bridgePort is the [LinkMiddleware] installed on each bridge member, it
+// learns source MAC addresses and forwards or floods frames to sibling
+// members through the owning Bridge.
+type bridgePort struct {
+	bridge *Bridge
+	nicID  tcpip.NICID
+}
+
+func (p *bridgePort) Wrap(ep stack.LinkEndpoint) stack.LinkEndpoint {
+	return &bridgeEndpoint{LinkEndpoint: ep, port: p}
+}
+
+type bridgeEndpoint struct {
+	stack.LinkEndpoint
+	port *bridgePort
+}
+
+func (e *bridgeEndpoint) Attach(d stack.NetworkDispatcher) {
+	e.LinkEndpoint.Attach(&bridgeDispatcher{NetworkDispatcher: d, port: e.port})
+}
+
+type bridgeDispatcher struct {
+	stack.NetworkDispatcher
+	port *bridgePort
+}
+
+func (d *bridgeDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	// pkt's data is the network-layer payload only, its ethertype passed
+	// separately as protocol: the real Ethernet header, if any, was
+	// consumed into pkt's link header by Interface.Inject (or the NIC RX
+	// path it mirrors). ToBuffer returns that link header ahead of the
+	// payload, so frame is the whole Ethernet frame.
+	if hdr := pkt.LinkHeader().Slice(); len(hdr) >= header.EthernetMinimumSize {
+		eth := header.Ethernet(hdr)
+		br := d.port.bridge
+		dst := eth.DestinationAddress()
+		frame := pkt.ToBuffer().Flatten()
+
+		br.learn(eth.SourceAddress(), d.port.nicID)
+		br.forward(d.port.nicID, dst, frame)
+
+		if br.shouldDeliverToBVI(dst) {
+			br.injectBVI(protocol, frame[len(hdr):])
+		}
+	}
+
+	// also deliver up this member's own stack NIC, for interfaces that
+	// additionally terminate traffic for their own configured address
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
+// shouldDeliverToBVI reports whether a frame addressed to dst must also be
+// delivered to the bridge's own virtual NIC, in addition to being forwarded
+// or flooded to sibling members: this is the case when dst is the BVI's own
+// MAC, a broadcast/multicast address, or a unicast address not (or no longer)
+// present in the learning table, mirroring the flooding behaviour of
+// forward.
+func (br *Bridge) shouldDeliverToBVI(dst tcpip.LinkAddress) bool {
+	if dst == br.bvi.LinkAddress() || isGroupAddress(dst) {
+		return true
+	}
+
+	br.mu.Lock()
+	entry, ok := br.table[dst]
+	br.mu.Unlock()
+
+	return !ok || time.Since(entry.seen) > br.aging()
+}
+
+// injectBVI delivers payload, a frame's network-layer payload (Ethernet
+// header already stripped), to the BVI's own NIC for IP-stack processing, as
+// if it had arrived directly on it, so that ARP/NDP and traffic addressed to
+// the bridge's own IP are reachable from members.
+func (br *Bridge) injectBVI(protocol tcpip.NetworkProtocolNumber, payload []byte) {
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), payload...)),
+	})
+	defer pkt.DecRef()
+
+	br.bvi.InjectInbound(protocol, pkt)
+}
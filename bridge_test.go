@@ -0,0 +1,145 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+func newTestBridge(t *testing.T) *Bridge {
+	t.Helper()
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, ipv6.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+
+	br, err := NewBridge(s, 100, "")
+
+	if err != nil {
+		t.Fatalf("NewBridge() = %v", err)
+	}
+
+	return br
+}
+
+func TestBridgeAddMemberAllocatesUniqueNICID(t *testing.T) {
+	br := newTestBridge(t)
+
+	a := &Interface{Stack: br.Stack}
+	b := &Interface{Stack: br.Stack}
+
+	if err := br.AddMember(a); err != nil {
+		t.Fatalf("AddMember(a) = %v", err)
+	}
+
+	if err := br.AddMember(b); err != nil {
+		t.Fatalf("AddMember(b) = %v", err)
+	}
+
+	if a.NICID == 0 || b.NICID == 0 {
+		t.Fatalf("expected non-zero NICIDs, got a=%d b=%d", a.NICID, b.NICID)
+	}
+
+	if a.NICID == b.NICID {
+		t.Fatalf("expected distinct NICIDs, both members got %d", a.NICID)
+	}
+
+	if len(br.members) != 2 {
+		t.Fatalf("len(br.members) = %d, want 2", len(br.members))
+	}
+}
+
+func TestBridgeAddMemberRejectsDuplicate(t *testing.T) {
+	br := newTestBridge(t)
+
+	a := &Interface{Stack: br.Stack, NICID: 5}
+
+	if err := br.AddMember(a); err != nil {
+		t.Fatalf("AddMember() = %v", err)
+	}
+
+	if err := br.AddMember(a); err == nil {
+		t.Fatal("AddMember() on an already registered NICID = nil, want error")
+	}
+}
+
+func TestBridgeLearn(t *testing.T) {
+	br := newTestBridge(t)
+
+	mac := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	br.learn(mac, 5)
+
+	br.mu.Lock()
+	entry, ok := br.table[mac]
+	br.mu.Unlock()
+
+	if !ok || entry.nic != 5 {
+		t.Fatalf("table[%q] = %+v, ok=%v, want nic=5", mac, entry, ok)
+	}
+}
+
+func TestBridgeShouldDeliverToBVI(t *testing.T) {
+	br := newTestBridge(t)
+	br.Aging = time.Minute
+
+	known := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+	aged := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x02")
+	unknown := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x03")
+
+	br.mu.Lock()
+	br.table[known] = bridgeEntry{nic: 5, seen: time.Now()}
+	br.table[aged] = bridgeEntry{nic: 5, seen: time.Now().Add(-time.Hour)}
+	br.mu.Unlock()
+
+	cases := []struct {
+		name string
+		dst  tcpip.LinkAddress
+		want bool
+	}{
+		{"own MAC", br.bvi.LinkAddress(), true},
+		{"broadcast", header.EthernetBroadcastAddress, true},
+		{"unknown unicast", unknown, true},
+		{"aged unicast", aged, true},
+		{"known unicast", known, false},
+	}
+
+	for _, c := range cases {
+		if got := br.shouldDeliverToBVI(c.dst); got != c.want {
+			t.Errorf("shouldDeliverToBVI(%s) = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+func TestBridgeForwardEvictsAgedEntries(t *testing.T) {
+	br := newTestBridge(t)
+	br.Aging = time.Minute
+
+	mac := tcpip.LinkAddress("\x02\x00\x00\x00\x00\x01")
+
+	br.mu.Lock()
+	br.table[mac] = bridgeEntry{nic: 5, seen: time.Now().Add(-time.Hour)}
+	br.mu.Unlock()
+
+	br.forward(0, mac, make([]byte, 64))
+
+	br.mu.Lock()
+	_, ok := br.table[mac]
+	br.mu.Unlock()
+
+	if ok {
+		t.Fatal("forward() kept an entry older than Aging in the table")
+	}
+}
@@ -0,0 +1,546 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// DHCPv4 ports, BOOTP layout sizes and well known constants (RFC 2131).
+const (
+	dhcpClientPort = 68
+	dhcpServerPort = 67
+
+	dhcpMagicCookie = 0x63825363
+
+	bootRequest = 1
+	bootReply   = 2
+
+	htypeEthernet = 1
+	hlenEthernet  = 6
+
+	bootpFixedLen = 236 // op..file, excluding the magic cookie and options
+)
+
+// DHCP option codes used by this client (RFC 2132).
+const (
+	optSubnetMask    = 1
+	optRouter        = 3
+	optDNS           = 6
+	optRequestedIP   = 50
+	optLeaseTime     = 51
+	optMessageType   = 53
+	optServerID      = 54
+	optParameterList = 55
+	optEnd           = 255
+)
+
+// DHCP message types (option 53, RFC 2132).
+const (
+	dhcpMsgDiscover = 1
+	dhcpMsgOffer    = 2
+	dhcpMsgRequest  = 3
+	dhcpMsgAck      = 5
+	dhcpMsgNak      = 6
+)
+
+const (
+	dhcpTimeout     = 4 * time.Second
+	dhcpRetries     = 4
+	dhcpMinLease    = 60 * time.Second
+	dhcpRenewScale  = 0.5   // T1, RFC 2131 section 4.4.5
+	dhcpRebindScale = 0.875 // T2, RFC 2131 section 4.4.5
+)
+
+// Lease represents a DHCPv4 lease acquired through Interface.InitDHCP.
+type Lease struct {
+	IP      net.IP
+	Netmask net.IPMask
+	Gateway net.IP
+	DNS     []net.IP
+	Server  net.IP
+
+	Acquired time.Time
+	Duration time.Duration
+}
+
+// Expires returns the absolute time at which the lease expires.
+func (l *Lease) Expires() time.Time {
+	return l.Acquired.Add(l.Duration)
+}
+
+// dhcpPacket is a parsed BOOTP/DHCP message.
+type dhcpPacket struct {
+	op      byte
+	xid     uint32
+	yiaddr  net.IP
+	siaddr  net.IP
+	options map[byte][]byte
+}
+
+func (p *dhcpPacket) msgType() byte {
+	if v, ok := p.options[optMessageType]; ok && len(v) == 1 {
+		return v[0]
+	}
+
+	return 0
+}
+
+func (p *dhcpPacket) ip4(opt byte) net.IP {
+	v, ok := p.options[opt]
+
+	if !ok || len(v) != 4 {
+		return nil
+	}
+
+	return net.IP(v)
+}
+
+func (p *dhcpPacket) ip4List(opt byte) []net.IP {
+	v, ok := p.options[opt]
+
+	if !ok || len(v)%4 != 0 {
+		return nil
+	}
+
+	ips := make([]net.IP, 0, len(v)/4)
+
+	for i := 0; i < len(v); i += 4 {
+		ips = append(ips, net.IP(v[i:i+4]))
+	}
+
+	return ips
+}
+
+func (p *dhcpPacket) leaseDuration() time.Duration {
+	v, ok := p.options[optLeaseTime]
+
+	if !ok || len(v) != 4 {
+		return dhcpMinLease
+	}
+
+	secs := binary.BigEndian.Uint32(v)
+
+	if secs == 0 {
+		return dhcpMinLease
+	}
+
+	return time.Duration(secs) * time.Second
+}
+
+// buildDHCP builds a BOOTP/DHCP message of the given type.
+func buildDHCP(msgType byte, xid uint32, chaddr net.HardwareAddr, ciaddr net.IP, options map[byte][]byte) []byte {
+	buf := make([]byte, bootpFixedLen, bootpFixedLen+64)
+
+	buf[0] = bootRequest
+	buf[1] = htypeEthernet
+	buf[2] = hlenEthernet
+	binary.BigEndian.PutUint32(buf[4:8], xid)
+
+	if ciaddr != nil {
+		copy(buf[12:16], ciaddr.To4())
+	}
+
+	copy(buf[28:28+len(chaddr)], chaddr)
+
+	cookie := make([]byte, 4)
+	binary.BigEndian.PutUint32(cookie, dhcpMagicCookie)
+	buf = append(buf, cookie...)
+
+	buf = append(buf, optMessageType, 1, msgType)
+
+	for _, opt := range []byte{optRequestedIP, optServerID, optParameterList} {
+		if v, ok := options[opt]; ok {
+			buf = append(buf, opt, byte(len(v)))
+			buf = append(buf, v...)
+		}
+	}
+
+	buf = append(buf, optEnd)
+
+	return buf
+}
+
+func buildDiscover(xid uint32, chaddr net.HardwareAddr) []byte {
+	params := []byte{optSubnetMask, optRouter, optDNS, optLeaseTime}
+
+	return buildDHCP(dhcpMsgDiscover, xid, chaddr, nil, map[byte][]byte{
+		optParameterList: params,
+	})
+}
+
+func buildRequest(xid uint32, chaddr net.HardwareAddr, offer *dhcpPacket) []byte {
+	params := []byte{optSubnetMask, optRouter, optDNS, optLeaseTime}
+
+	return buildDHCP(dhcpMsgRequest, xid, chaddr, nil, map[byte][]byte{
+		optRequestedIP:   offer.yiaddr.To4(),
+		optServerID:      offer.ip4(optServerID).To4(),
+		optParameterList: params,
+	})
+}
+
+// buildRenewRequest builds a unicast renewal request (RFC 2131 section 4.4.5,
+// states RENEWING/REBINDING), which carries ciaddr instead of option 50/54.
+func buildRenewRequest(xid uint32, chaddr net.HardwareAddr, ciaddr net.IP) []byte {
+	return buildDHCP(dhcpMsgRequest, xid, chaddr, ciaddr, nil)
+}
+
+// parseDHCP parses a BOOTP/DHCP message, returning an error if it is
+// malformed or not a DHCP (as opposed to plain BOOTP) message.
+func parseDHCP(buf []byte) (*dhcpPacket, error) {
+	if len(buf) < bootpFixedLen+4 {
+		return nil, errors.New("dhcp: short packet")
+	}
+
+	if binary.BigEndian.Uint32(buf[bootpFixedLen:bootpFixedLen+4]) != dhcpMagicCookie {
+		return nil, errors.New("dhcp: missing magic cookie")
+	}
+
+	p := &dhcpPacket{
+		op:      buf[0],
+		xid:     binary.BigEndian.Uint32(buf[4:8]),
+		yiaddr:  net.IP(append([]byte{}, buf[16:20]...)),
+		siaddr:  net.IP(append([]byte{}, buf[20:24]...)),
+		options: make(map[byte][]byte),
+	}
+
+	opts := buf[bootpFixedLen+4:]
+
+	for len(opts) > 0 {
+		code := opts[0]
+
+		if code == optEnd {
+			break
+		}
+
+		if code == 0 { // pad
+			opts = opts[1:]
+			continue
+		}
+
+		if len(opts) < 2 {
+			break
+		}
+
+		n := int(opts[1])
+
+		if len(opts) < 2+n {
+			break
+		}
+
+		p.options[code] = append([]byte{}, opts[2:2+n]...)
+		opts = opts[2+n:]
+	}
+
+	return p, nil
+}
+
+func (p *dhcpPacket) lease() *Lease {
+	return &Lease{
+		IP:       p.yiaddr,
+		Netmask:  net.IPMask(p.ip4(optSubnetMask)),
+		Gateway:  p.ip4(optRouter),
+		DNS:      p.ip4List(optDNS),
+		Server:   p.ip4(optServerID),
+		Duration: p.leaseDuration(),
+	}
+}
+
+// dhcpXID returns a random DHCP transaction identifier.
+func dhcpXID() uint32 {
+	var b [4]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// dhcpExchange performs a DISCOVER/OFFER/REQUEST/ACK exchange and returns the
+// acquired lease.
+func (iface *Interface) dhcpExchange(chaddr net.HardwareAddr) (*Lease, error) {
+	var wq waiter.Queue
+
+	ep, tcpErr := iface.Stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpErr != nil {
+		return nil, fmt.Errorf("endpoint error (dhcp): %v", tcpErr)
+	}
+
+	defer ep.Close()
+
+	if tcpErr := ep.SetSockOptBool(tcpip.BroadcastOption, true); tcpErr != nil {
+		return nil, fmt.Errorf("broadcast option error (dhcp): %v", tcpErr)
+	}
+
+	if tcpErr := ep.Bind(tcpip.FullAddress{Port: dhcpClientPort, NIC: iface.NICID}); tcpErr != nil {
+		return nil, fmt.Errorf("bind error (dhcp endpoint): %v", tcpErr)
+	}
+
+	we, ch := waiter.NewChannelEntry()
+	wq.EventRegister(&we, waiter.ReadableEvents)
+	defer wq.EventUnregister(&we)
+
+	broadcast := tcpip.FullAddress{
+		Addr: tcpip.AddrFrom4([4]byte{255, 255, 255, 255}),
+		Port: dhcpServerPort,
+		NIC:  iface.NICID,
+	}
+
+	xid := dhcpXID()
+
+	offer, err := dhcpRoundTrip(ep, ch, broadcast, buildDiscover(xid, chaddr), xid, dhcpMsgOffer)
+
+	if err != nil {
+		return nil, fmt.Errorf("dhcp discover: %w", err)
+	}
+
+	ack, err := dhcpRoundTrip(ep, ch, broadcast, buildRequest(xid, chaddr, offer), xid, dhcpMsgAck)
+
+	if err != nil {
+		return nil, fmt.Errorf("dhcp request: %w", err)
+	}
+
+	lease := ack.lease()
+	lease.Acquired = time.Now()
+
+	return lease, nil
+}
+
+// dhcpRoundTrip sends pkt to dst and waits for a matching reply of the
+// expected message type, retrying with a doubling timeout on loss.
+func dhcpRoundTrip(ep tcpip.Endpoint, ch chan struct{}, dst tcpip.FullAddress, pkt []byte, xid uint32, want byte) (*dhcpPacket, error) {
+	timeout := dhcpTimeout
+
+	for attempt := 0; attempt < dhcpRetries; attempt++ {
+		if _, tcpErr := ep.Write(bytes.NewReader(pkt), tcpip.WriteOptions{To: &dst}); tcpErr != nil {
+			return nil, fmt.Errorf("write error: %v", tcpErr)
+		}
+
+		deadline := time.After(timeout)
+
+	readLoop:
+		for {
+			select {
+			case <-ch:
+				var buf bytes.Buffer
+
+				if _, tcpErr := ep.Read(&buf, tcpip.ReadOptions{}); tcpErr != nil {
+					continue readLoop
+				}
+
+				reply, err := parseDHCP(buf.Bytes())
+
+				if err != nil || reply.op != bootReply || reply.xid != xid {
+					continue readLoop
+				}
+
+				if reply.msgType() == dhcpMsgNak {
+					return nil, errors.New("received NAK")
+				}
+
+				if reply.msgType() == want {
+					return reply, nil
+				}
+			case <-deadline:
+				break readLoop
+			}
+		}
+
+		timeout *= 2
+	}
+
+	return nil, errors.New("timed out")
+}
+
+// InitDHCP initializes a [NetworkDevice] and acquires an IPv4 address,
+// netmask, default gateway, DNS servers and lease time through DHCPv4, in
+// lieu of the static configuration accepted by Init. A random MAC address is
+// set if its argument is empty.
+//
+// The lease is renewed in the background (T1, 50% of the lease) and rebound
+// (T2, 87.5% of the lease) as required by RFC 2131, the most recently
+// acquired lease is always available through Interface.Lease.Load().
+func (iface *Interface) InitDHCP(nic NetworkDevice, mac string) (err error) {
+	var laddr net.HardwareAddr
+
+	if len(mac) == 0 {
+		laddr = randomMAC()
+	} else {
+		if laddr, err = net.ParseMAC(mac); err != nil {
+			return
+		}
+	}
+
+	if iface.NICID == 0 {
+		iface.NICID = nextNICID(iface.Stack)
+	}
+
+	if err = iface.createNIC(laddr.String()); err != nil {
+		return
+	}
+
+	lease, err := iface.dhcpExchange(laddr)
+
+	if err != nil {
+		return fmt.Errorf("dhcp error: %w", err)
+	}
+
+	if err = iface.applyLease(lease); err != nil {
+		return
+	}
+
+	if iface.NIC == nil {
+		iface.NIC = &NIC{
+			MAC:    laddr,
+			Link:   iface.Link,
+			Device: nic,
+		}
+
+		if err = iface.NIC.Init(); err != nil {
+			return
+		}
+	}
+
+	go iface.maintainLease(laddr)
+
+	return nil
+}
+
+// applyLease installs the address, netmask and default gateway carried by
+// lease onto the interface NIC.
+func (iface *Interface) applyLease(lease *Lease) error {
+	ip := tcpip.AddressWithPrefix{
+		Address:   tcpip.AddrFromSlice(lease.IP.To4()),
+		PrefixLen: tcpip.MaskFromBytes(lease.Netmask).Prefix(),
+	}
+
+	var gws []tcpip.Address
+
+	if lease.Gateway != nil {
+		gws = append(gws, tcpip.AddrFromSlice(lease.Gateway.To4()))
+	}
+
+	if err := iface.addAddresses([]tcpip.AddressWithPrefix{ip}, gws); err != nil {
+		return err
+	}
+
+	iface.Lease.Store(lease)
+
+	return nil
+}
+
+// maintainLease renews, rebinds or re-acquires the DHCP lease as it
+// approaches expiration. It returns only when Interface.Lease is nil;
+// nothing in this package clears it, so the loop otherwise runs
+// indefinitely.
+func (iface *Interface) maintainLease(chaddr net.HardwareAddr) {
+	for {
+		lease := iface.Lease.Load()
+
+		if lease == nil {
+			return
+		}
+
+		t1 := lease.Acquired.Add(time.Duration(float64(lease.Duration) * dhcpRenewScale))
+		t2 := lease.Acquired.Add(time.Duration(float64(lease.Duration) * dhcpRebindScale))
+
+		switch {
+		case time.Now().Before(t1):
+			time.Sleep(time.Until(t1))
+			continue
+		case time.Now().Before(t2):
+			// RENEW, RFC 2131 section 4.4.5: unicast to the known lease server.
+			if renewed, err := iface.renewLease(chaddr, lease, false); err == nil {
+				if err := iface.applyLease(renewed); err == nil {
+					continue
+				}
+			}
+
+			time.Sleep(time.Until(t2))
+		case time.Now().Before(lease.Expires()):
+			// REBIND, RFC 2131 section 4.4.5: broadcast, any server may reply.
+			if renewed, err := iface.renewLease(chaddr, lease, true); err == nil {
+				if err := iface.applyLease(renewed); err == nil {
+					continue
+				}
+			}
+
+			time.Sleep(dhcpTimeout)
+		default:
+			renewed, err := iface.dhcpExchange(chaddr)
+
+			if err != nil {
+				// lease lost, back off and retry DISCOVER
+				time.Sleep(dhcpTimeout)
+				continue
+			}
+
+			if err := iface.applyLease(renewed); err != nil {
+				// failed to install the new lease onto the NIC, back off and
+				// retry rather than spinning with nothing applied
+				time.Sleep(dhcpTimeout)
+			}
+		}
+	}
+}
+
+// renewLease performs a RENEW or REBIND request for lease as described in
+// RFC 2131 section 4.4.5: a RENEW (rebind false) is unicast to the known
+// lease server, a REBIND (rebind true) is broadcast so that any server on
+// the link may reply.
+func (iface *Interface) renewLease(chaddr net.HardwareAddr, lease *Lease, rebind bool) (*Lease, error) {
+	var wq waiter.Queue
+
+	ep, tcpErr := iface.Stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if tcpErr != nil {
+		return nil, fmt.Errorf("endpoint error (dhcp): %v", tcpErr)
+	}
+
+	defer ep.Close()
+
+	if tcpErr := ep.SetSockOptBool(tcpip.BroadcastOption, true); tcpErr != nil {
+		return nil, fmt.Errorf("broadcast option error (dhcp): %v", tcpErr)
+	}
+
+	if tcpErr := ep.Bind(tcpip.FullAddress{Addr: tcpip.AddrFromSlice(lease.IP.To4()), Port: dhcpClientPort, NIC: iface.NICID}); tcpErr != nil {
+		return nil, fmt.Errorf("bind error (dhcp endpoint): %v", tcpErr)
+	}
+
+	we, ch := waiter.NewChannelEntry()
+	wq.EventRegister(&we, waiter.ReadableEvents)
+	defer wq.EventUnregister(&we)
+
+	dst := tcpip.FullAddress{Port: dhcpServerPort, NIC: iface.NICID}
+
+	if !rebind && lease.Server != nil {
+		dst.Addr = tcpip.AddrFromSlice(lease.Server.To4())
+	} else {
+		dst.Addr = tcpip.AddrFrom4([4]byte{255, 255, 255, 255})
+	}
+
+	xid := dhcpXID()
+
+	reply, err := dhcpRoundTrip(ep, ch, dst, buildRenewRequest(xid, chaddr, lease.IP), xid, dhcpMsgAck)
+
+	if err != nil {
+		return nil, err
+	}
+
+	renewed := reply.lease()
+	renewed.Acquired = time.Now()
+
+	return renewed, nil
+}
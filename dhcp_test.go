@@ -0,0 +1,87 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBuildParseDHCPDiscover(t *testing.T) {
+	chaddr := net.HardwareAddr{0x02, 0x00, 0x00, 0x00, 0x00, 0x01}
+	xid := uint32(0xdeadbeef)
+
+	p, err := parseDHCP(buildDiscover(xid, chaddr))
+
+	if err != nil {
+		t.Fatalf("parseDHCP() = %v", err)
+	}
+
+	if p.xid != xid {
+		t.Errorf("xid = %#x, want %#x", p.xid, xid)
+	}
+
+	if p.msgType() != dhcpMsgDiscover {
+		t.Errorf("msgType() = %d, want %d", p.msgType(), dhcpMsgDiscover)
+	}
+
+	if params := p.options[optParameterList]; len(params) != 4 {
+		t.Errorf("optParameterList = %v, want 4 bytes", params)
+	}
+}
+
+func TestParseDHCPRejectsMalformedPackets(t *testing.T) {
+	if _, err := parseDHCP(make([]byte, 4)); err == nil {
+		t.Error("parseDHCP() on a short packet = nil error, want one")
+	}
+
+	if _, err := parseDHCP(make([]byte, bootpFixedLen+4)); err == nil {
+		t.Error("parseDHCP() on a packet missing the magic cookie = nil error, want one")
+	}
+}
+
+func TestDHCPPacketLease(t *testing.T) {
+	p := &dhcpPacket{
+		yiaddr: net.IPv4(192, 168, 1, 10),
+		options: map[byte][]byte{
+			optSubnetMask: {255, 255, 255, 0},
+			optRouter:     {192, 168, 1, 1},
+			optServerID:   {192, 168, 1, 254},
+			optLeaseTime:  {0, 0, 0x0e, 0x10}, // 3600 seconds
+		},
+	}
+
+	lease := p.lease()
+
+	if !lease.IP.Equal(net.IPv4(192, 168, 1, 10)) {
+		t.Errorf("IP = %v", lease.IP)
+	}
+
+	if !net.IP(lease.Netmask).Equal(net.IPv4(255, 255, 255, 0)) {
+		t.Errorf("Netmask = %v", lease.Netmask)
+	}
+
+	if !lease.Gateway.Equal(net.IPv4(192, 168, 1, 1)) {
+		t.Errorf("Gateway = %v", lease.Gateway)
+	}
+
+	if !lease.Server.Equal(net.IPv4(192, 168, 1, 254)) {
+		t.Errorf("Server = %v", lease.Server)
+	}
+
+	if lease.Duration != 3600*time.Second {
+		t.Errorf("Duration = %v, want 1h", lease.Duration)
+	}
+}
+
+func TestDHCPPacketLeaseDurationDefaultsWhenMissing(t *testing.T) {
+	p := &dhcpPacket{options: map[byte][]byte{}}
+
+	if got := p.leaseDuration(); got != dhcpMinLease {
+		t.Errorf("leaseDuration() = %v, want %v", got, dhcpMinLease)
+	}
+}
@@ -0,0 +1,294 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"encoding/binary"
+	"math"
+	"net"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// PCAPMiddleware is a [LinkMiddleware] that mirrors every frame flowing
+// through the link to a [PCAPWriter], for offline analysis.
+type PCAPMiddleware struct {
+	Writer *PCAPWriter
+}
+
+func (m *PCAPMiddleware) Wrap(ep stack.LinkEndpoint) stack.LinkEndpoint {
+	return &pcapEndpoint{LinkEndpoint: ep, w: m.Writer}
+}
+
+type pcapEndpoint struct {
+	stack.LinkEndpoint
+	w *PCAPWriter
+}
+
+func (e *pcapEndpoint) Attach(d stack.NetworkDispatcher) {
+	e.LinkEndpoint.Attach(&pcapDispatcher{NetworkDispatcher: d, w: e.w})
+}
+
+func (e *pcapEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	for _, pkt := range pkts.AsSlice() {
+		// outbound packets carry no Ethernet header of their own, one is
+		// built from the link addresses the stack resolved for them
+		src := pkt.EgressRoute.LocalLinkAddress
+
+		if len(src) == 0 {
+			src = e.LinkEndpoint.LinkAddress()
+		}
+
+		frame := make([]byte, header.EthernetMinimumSize)
+		header.Ethernet(frame).Encode(&header.EthernetFields{
+			SrcAddr: src,
+			DstAddr: pkt.EgressRoute.RemoteLinkAddress,
+			Type:    pkt.NetworkProtocolNumber,
+		})
+
+		e.w.WriteFrame(Frame{Timestamp: time.Now(), Direction: TX, Data: append(frame, pkt.ToBuffer().Flatten()...)})
+	}
+
+	return e.LinkEndpoint.WritePackets(pkts)
+}
+
+type pcapDispatcher struct {
+	stack.NetworkDispatcher
+	w *PCAPWriter
+}
+
+func (d *pcapDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	d.w.WriteFrame(Frame{Timestamp: time.Now(), Direction: RX, Data: pkt.ToBuffer().Flatten()})
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
+// FilterAction is the action taken by a matching [FilterRule].
+type FilterAction int
+
+const (
+	// Allow lets a matching packet through.
+	Allow FilterAction = iota
+	// Deny drops a matching packet.
+	Deny
+)
+
+// FilterRule matches packets by source/destination network, transport
+// protocol and port, nil/zero fields are wildcards.
+type FilterRule struct {
+	Action   FilterAction
+	Src      *net.IPNet
+	Dst      *net.IPNet
+	Port     uint16
+	Protocol tcpip.TransportProtocolNumber
+}
+
+func (r *FilterRule) match(ip header.IPv4) bool {
+	if r.Src != nil && !r.Src.Contains(net.IP(ip.SourceAddress().AsSlice())) {
+		return false
+	}
+
+	if r.Dst != nil && !r.Dst.Contains(net.IP(ip.DestinationAddress().AsSlice())) {
+		return false
+	}
+
+	if r.Protocol != 0 && tcpip.TransportProtocolNumber(ip.TransportProtocol()) != r.Protocol {
+		return false
+	}
+
+	if r.Port != 0 {
+		payload := ip.Payload()
+
+		if len(payload) < 4 {
+			return false
+		}
+
+		srcPort := binary.BigEndian.Uint16(payload[0:2])
+		dstPort := binary.BigEndian.Uint16(payload[2:4])
+
+		if srcPort != r.Port && dstPort != r.Port {
+			return false
+		}
+	}
+
+	return true
+}
+
+// FilterMiddleware is a stateless [LinkMiddleware] firewall, Rules are
+// evaluated in order on both RX and TX, the first match wins, Default
+// applies when nothing matches.
+type FilterMiddleware struct {
+	Rules   []FilterRule
+	Default FilterAction
+}
+
+func (m *FilterMiddleware) Wrap(ep stack.LinkEndpoint) stack.LinkEndpoint {
+	return &filterEndpoint{LinkEndpoint: ep, mw: m}
+}
+
+func (m *FilterMiddleware) allow(data []byte) bool {
+	if ip := header.IPv4(data); len(data) >= header.IPv4MinimumSize && ip.IsValid(len(data)) {
+		for i := range m.Rules {
+			if m.Rules[i].match(ip) {
+				return m.Rules[i].Action == Allow
+			}
+		}
+	}
+
+	return m.Default == Allow
+}
+
+// networkPayload returns pkt's network-layer payload, stripping any Ethernet
+// header consumed into its link header (e.g. by Interface.Inject, or the NIC
+// RX path it mirrors) so that allow always sees data starting at the IP
+// header, regardless of whether pkt still carries one.
+func networkPayload(pkt *stack.PacketBuffer) []byte {
+	return pkt.ToBuffer().Flatten()[len(pkt.LinkHeader().Slice()):]
+}
+
+type filterEndpoint struct {
+	stack.LinkEndpoint
+	mw *FilterMiddleware
+}
+
+func (e *filterEndpoint) Attach(d stack.NetworkDispatcher) {
+	e.LinkEndpoint.Attach(&filterDispatcher{NetworkDispatcher: d, mw: e.mw})
+}
+
+func (e *filterEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	var allowed stack.PacketBufferList
+
+	for _, pkt := range pkts.AsSlice() {
+		if e.mw.allow(networkPayload(pkt)) {
+			allowed.PushBack(pkt)
+		}
+	}
+
+	if _, err := e.LinkEndpoint.WritePackets(allowed); err != nil {
+		return 0, err
+	}
+
+	// denied packets are silently consumed, not reported as a write failure
+	return pkts.Len(), nil
+}
+
+type filterDispatcher struct {
+	stack.NetworkDispatcher
+	mw *FilterMiddleware
+}
+
+func (d *filterDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if !d.mw.allow(networkPayload(pkt)) {
+		return
+	}
+
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
+// tokenBucket is a minimal token bucket rate limiter.
+type tokenBucket struct {
+	mu sync.Mutex
+
+	rate     float64 // tokens per second
+	capacity float64
+	tokens   float64
+	last     time.Time
+}
+
+func newTokenBucket(rate float64, capacity float64) *tokenBucket {
+	return &tokenBucket{rate: rate, capacity: capacity, tokens: capacity, last: time.Now()}
+}
+
+func (b *tokenBucket) allow(n float64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens = math.Min(b.capacity, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+
+	if b.tokens < n {
+		return false
+	}
+
+	b.tokens -= n
+
+	return true
+}
+
+// RateLimitMiddleware is a [LinkMiddleware] token-bucket rate limiter,
+// applied independently to each direction, a nil bucket leaves that
+// direction unlimited. Packets exceeding the rate are dropped.
+type RateLimitMiddleware struct {
+	RX *tokenBucket
+	TX *tokenBucket
+}
+
+// NewRateLimitMiddleware returns a RateLimitMiddleware enforcing rxBytesPerSec
+// and txBytesPerSec, each with a burst capacity of burstBytes, a zero rate
+// leaves that direction unlimited.
+func NewRateLimitMiddleware(rxBytesPerSec, txBytesPerSec, burstBytes int) *RateLimitMiddleware {
+	m := &RateLimitMiddleware{}
+
+	if rxBytesPerSec > 0 {
+		m.RX = newTokenBucket(float64(rxBytesPerSec), float64(burstBytes))
+	}
+
+	if txBytesPerSec > 0 {
+		m.TX = newTokenBucket(float64(txBytesPerSec), float64(burstBytes))
+	}
+
+	return m
+}
+
+func (m *RateLimitMiddleware) Wrap(ep stack.LinkEndpoint) stack.LinkEndpoint {
+	return &rateLimitEndpoint{LinkEndpoint: ep, mw: m}
+}
+
+type rateLimitEndpoint struct {
+	stack.LinkEndpoint
+	mw *RateLimitMiddleware
+}
+
+func (e *rateLimitEndpoint) Attach(d stack.NetworkDispatcher) {
+	e.LinkEndpoint.Attach(&rateLimitDispatcher{NetworkDispatcher: d, mw: e.mw})
+}
+
+func (e *rateLimitEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if e.mw.TX == nil {
+		return e.LinkEndpoint.WritePackets(pkts)
+	}
+
+	var allowed stack.PacketBufferList
+
+	for _, pkt := range pkts.AsSlice() {
+		if e.mw.TX.allow(float64(pkt.Size())) {
+			allowed.PushBack(pkt)
+		}
+	}
+
+	if _, err := e.LinkEndpoint.WritePackets(allowed); err != nil {
+		return 0, err
+	}
+
+	return pkts.Len(), nil
+}
+
+type rateLimitDispatcher struct {
+	stack.NetworkDispatcher
+	mw *RateLimitMiddleware
+}
+
+func (d *rateLimitDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if d.mw.RX != nil && !d.mw.RX.allow(float64(pkt.Size())) {
+		return
+	}
+
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
@@ -0,0 +1,227 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// recordingMiddleware is a [LinkMiddleware] stub that counts the frames
+// reaching it from each direction, standing in for the real stack NIC so
+// that FilterMiddleware's behaviour can be observed without a full protocol
+// exchange.
+type recordingMiddleware struct {
+	delivered int
+	written   int
+}
+
+func (m *recordingMiddleware) Wrap(ep stack.LinkEndpoint) stack.LinkEndpoint {
+	return &recordingEndpoint{LinkEndpoint: ep, mw: m}
+}
+
+type recordingEndpoint struct {
+	stack.LinkEndpoint
+	mw *recordingMiddleware
+}
+
+func (e *recordingEndpoint) Attach(d stack.NetworkDispatcher) {
+	e.LinkEndpoint.Attach(&recordingDispatcher{NetworkDispatcher: d, mw: e.mw})
+}
+
+func (e *recordingEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	e.mw.written += pkts.Len()
+	return pkts.Len(), nil
+}
+
+type recordingDispatcher struct {
+	stack.NetworkDispatcher
+	mw *recordingMiddleware
+}
+
+func (d *recordingDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	d.mw.delivered++
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
+// newTestFilteredInterface returns an Interface with mw installed ahead of a
+// recordingMiddleware standing in for the real stack NIC.
+func newTestFilteredInterface(t *testing.T, mw *FilterMiddleware) (*Interface, *recordingMiddleware) {
+	t.Helper()
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+	})
+
+	iface := &Interface{Stack: s, NICID: 1}
+	rec := &recordingMiddleware{}
+	iface.Use(mw, rec)
+
+	if err := iface.createNIC("02:00:00:00:00:01"); err != nil {
+		t.Fatalf("createNIC() = %v", err)
+	}
+
+	return iface, rec
+}
+
+func buildIPv4(t *testing.T, proto tcpip.TransportProtocolNumber, src string, dst string, payload []byte) header.IPv4 {
+	t.Helper()
+
+	buf := make([]byte, header.IPv4MinimumSize+len(payload))
+	ip := header.IPv4(buf)
+
+	ip.Encode(&header.IPv4Fields{
+		TotalLength: uint16(len(buf)),
+		TTL:         64,
+		Protocol:    uint8(proto),
+		SrcAddr:     tcpip.AddrFromSlice(net.ParseIP(src).To4()),
+		DstAddr:     tcpip.AddrFromSlice(net.ParseIP(dst).To4()),
+	})
+	copy(buf[header.IPv4MinimumSize:], payload)
+	ip.SetChecksum(^ip.CalculateChecksum())
+
+	return ip
+}
+
+func portPayload(src, dst uint16) []byte {
+	return []byte{byte(src >> 8), byte(src), byte(dst >> 8), byte(dst)}
+}
+
+func TestFilterRuleMatchByNetwork(t *testing.T) {
+	_, allowed, _ := net.ParseCIDR("10.0.0.0/24")
+	r := FilterRule{Src: allowed}
+
+	if !r.match(buildIPv4(t, 0, "10.0.0.5", "8.8.8.8", nil)) {
+		t.Error("expected match for a source inside the network")
+	}
+
+	if r.match(buildIPv4(t, 0, "10.0.1.5", "8.8.8.8", nil)) {
+		t.Error("expected no match for a source outside the network")
+	}
+}
+
+func TestFilterRuleMatchByProtocol(t *testing.T) {
+	r := FilterRule{Protocol: header.TCPProtocolNumber}
+
+	if !r.match(buildIPv4(t, header.TCPProtocolNumber, "10.0.0.1", "10.0.0.2", nil)) {
+		t.Error("expected match on matching protocol")
+	}
+
+	if r.match(buildIPv4(t, header.UDPProtocolNumber, "10.0.0.1", "10.0.0.2", nil)) {
+		t.Error("expected no match on mismatching protocol")
+	}
+}
+
+func TestFilterRuleMatchByPort(t *testing.T) {
+	r := FilterRule{Port: 53}
+
+	if !r.match(buildIPv4(t, header.UDPProtocolNumber, "10.0.0.1", "10.0.0.2", portPayload(12345, 53))) {
+		t.Error("expected match on destination port")
+	}
+
+	if r.match(buildIPv4(t, header.UDPProtocolNumber, "10.0.0.1", "10.0.0.2", portPayload(12345, 80))) {
+		t.Error("expected no match when neither port matches")
+	}
+}
+
+func TestFilterMiddlewareBlocksMatchingRXFrame(t *testing.T) {
+	mw := &FilterMiddleware{
+		Rules:   []FilterRule{{Action: Deny, Protocol: header.UDPProtocolNumber}},
+		Default: Allow,
+	}
+
+	iface, rec := newTestFilteredInterface(t, mw)
+
+	ip := buildIPv4(t, header.UDPProtocolNumber, "10.0.0.5", "10.0.0.1", portPayload(12345, 53))
+	frame := buildEthernet(t, "\x02\x00\x00\x00\x00\x02", iface.Link.LinkAddress(), ipv4.ProtocolNumber, ip)
+
+	if err := iface.Inject(frame); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	if rec.delivered != 0 {
+		t.Errorf("delivered = %d frames past a Deny rule, want 0", rec.delivered)
+	}
+}
+
+func TestFilterMiddlewareAllowsNonMatchingRXFrame(t *testing.T) {
+	mw := &FilterMiddleware{
+		Rules:   []FilterRule{{Action: Deny, Protocol: header.TCPProtocolNumber}},
+		Default: Allow,
+	}
+
+	iface, rec := newTestFilteredInterface(t, mw)
+
+	ip := buildIPv4(t, header.UDPProtocolNumber, "10.0.0.5", "10.0.0.1", portPayload(12345, 53))
+	frame := buildEthernet(t, "\x02\x00\x00\x00\x00\x02", iface.Link.LinkAddress(), ipv4.ProtocolNumber, ip)
+
+	if err := iface.Inject(frame); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	if rec.delivered != 1 {
+		t.Errorf("delivered = %d, want the unmatched UDP frame to reach the NIC", rec.delivered)
+	}
+}
+
+func TestFilterMiddlewareBlocksMatchingTXPacket(t *testing.T) {
+	mw := &FilterMiddleware{
+		Rules:   []FilterRule{{Action: Deny, Protocol: header.UDPProtocolNumber}},
+		Default: Allow,
+	}
+
+	rec := &recordingMiddleware{}
+	ip := buildIPv4(t, header.UDPProtocolNumber, "10.0.0.1", "10.0.0.5", portPayload(53, 12345))
+
+	e := &filterEndpoint{LinkEndpoint: &recordingEndpoint{mw: rec}, mw: mw}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), ip...)),
+	})
+	defer pkt.DecRef()
+
+	var pkts stack.PacketBufferList
+	pkts.PushBack(pkt)
+
+	if _, err := e.WritePackets(pkts); err != nil {
+		t.Fatalf("WritePackets() = %v", err)
+	}
+
+	if rec.written != 0 {
+		t.Errorf("written = %d packets past a Deny rule, want 0", rec.written)
+	}
+}
+
+func TestTokenBucketDeniesWhenExhausted(t *testing.T) {
+	b := newTokenBucket(1, 5)
+
+	if !b.allow(5) {
+		t.Fatal("allow(5) on a fresh bucket = false, want true")
+	}
+
+	if b.allow(1) {
+		t.Fatal("allow(1) right after exhausting the bucket = true, want false")
+	}
+}
+
+func TestTokenBucketRefillsOverTime(t *testing.T) {
+	b := newTokenBucket(10, 10)
+	b.tokens = 0
+	b.last = time.Now().Add(-time.Second)
+
+	if !b.allow(5) {
+		t.Fatal("allow(5) after a 1s refill at 10 tokens/s = false, want true")
+	}
+}
@@ -0,0 +1,138 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"fmt"
+	"net"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+	"gvisor.dev/gvisor/pkg/waiter"
+)
+
+// multicastSubnet is the IPv4 multicast address range, 224.0.0.0/4.
+var multicastSubnet = tcpip.AddressWithPrefix{
+	Address:   tcpip.AddrFrom4([4]byte{224, 0, 0, 0}),
+	PrefixLen: 4,
+}.Subnet()
+
+// JoinGroup joins the IPv4 multicast group identified by group on the
+// interface, it is a prerequisite for receiving datagrams sent to it.
+func (iface *Interface) JoinGroup(group net.IP) error {
+	addr := tcpip.AddrFromSlice(normalizeIP(group))
+
+	if err := iface.Stack.JoinGroup(ipv4.ProtocolNumber, iface.NICID, addr); err != nil {
+		return fmt.Errorf("join group error: %v", err)
+	}
+
+	iface.addMulticastRoute()
+
+	return nil
+}
+
+// LeaveGroup leaves a previously joined IPv4 multicast group.
+func (iface *Interface) LeaveGroup(group net.IP) error {
+	addr := tcpip.AddrFromSlice(normalizeIP(group))
+
+	if err := iface.Stack.LeaveGroup(ipv4.ProtocolNumber, iface.NICID, addr); err != nil {
+		return fmt.Errorf("leave group error: %v", err)
+	}
+
+	return nil
+}
+
+// addMulticastRoute ensures that the interface route table has an entry
+// routing the whole 224.0.0.0/4 range out of this interface, it is a no-op
+// if one is already present.
+func (iface *Interface) addMulticastRoute() {
+	rt := iface.Stack.GetRouteTable()
+
+	for _, r := range rt {
+		if r.Destination == multicastSubnet && r.NIC == iface.NICID {
+			return
+		}
+	}
+
+	rt = append(rt, tcpip.Route{
+		Destination: multicastSubnet,
+		NIC:         iface.NICID,
+	})
+
+	iface.Stack.SetRouteTable(rt)
+}
+
+// MulticastConn is a UDP endpoint bound to receive and send datagrams for a
+// joined multicast group.
+type MulticastConn struct {
+	tcpip.Endpoint
+
+	wq *waiter.Queue
+}
+
+// SetMulticastLoop controls whether outgoing datagrams are looped back to
+// local group members.
+func (c *MulticastConn) SetMulticastLoop(enabled bool) error {
+	if err := c.Endpoint.SetSockOptBool(tcpip.MulticastLoopOption, enabled); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+
+	return nil
+}
+
+// SetMulticastTTL sets the TTL used for outgoing multicast datagrams.
+func (c *MulticastConn) SetMulticastTTL(ttl int) error {
+	if err := c.Endpoint.SetSockOptInt(tcpip.MulticastTTLOption, ttl); err != nil {
+		return fmt.Errorf("%v", err)
+	}
+
+	return nil
+}
+
+// Readable registers for the connection's readable events and returns a
+// channel notified when a datagram is ready for Read, along with a function
+// that unregisters it. Endpoint.Read is non-blocking, so a caller must wait
+// on this channel (or otherwise poll) between calls rather than looping on
+// Read alone, the same pattern the DHCPv4 client uses for its own endpoint.
+func (c *MulticastConn) Readable() (<-chan struct{}, func()) {
+	we, ch := waiter.NewChannelEntry()
+	c.wq.EventRegister(&we, waiter.ReadableEvents)
+
+	return ch, func() {
+		c.wq.EventUnregister(&we)
+	}
+}
+
+// MulticastUDP joins group and returns a UDP endpoint bound to it on port,
+// with the appropriate multicast route installed, ready to send and receive
+// datagrams addressed to the group.
+func (iface *Interface) MulticastUDP(group net.IP, port uint16) (*MulticastConn, error) {
+	if err := iface.JoinGroup(group); err != nil {
+		return nil, err
+	}
+
+	var wq waiter.Queue
+
+	ep, err := iface.Stack.NewEndpoint(udp.ProtocolNumber, ipv4.ProtocolNumber, &wq)
+
+	if err != nil {
+		return nil, fmt.Errorf("endpoint error (multicast udp): %v", err)
+	}
+
+	addr := tcpip.FullAddress{
+		Addr: tcpip.AddrFromSlice(normalizeIP(group)),
+		Port: port,
+		NIC:  iface.NICID,
+	}
+
+	if err := ep.Bind(addr); err != nil {
+		ep.Close()
+		return nil, fmt.Errorf("bind error (multicast udp): %v", err)
+	}
+
+	return &MulticastConn{Endpoint: ep, wq: &wq}, nil
+}
@@ -0,0 +1,73 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAddMulticastRouteIsIdempotent(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+
+	iface.addMulticastRoute()
+	iface.addMulticastRoute()
+
+	matches := 0
+
+	for _, r := range iface.Stack.GetRouteTable() {
+		if r.Destination == multicastSubnet && r.NIC == iface.NICID {
+			matches++
+		}
+	}
+
+	if matches != 1 {
+		t.Errorf("got %d multicast routes, want exactly 1", matches)
+	}
+}
+
+func TestJoinLeaveGroup(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+
+	group := net.ParseIP("224.0.0.251")
+
+	if err := iface.JoinGroup(group); err != nil {
+		t.Fatalf("JoinGroup() = %v", err)
+	}
+
+	if err := iface.LeaveGroup(group); err != nil {
+		t.Fatalf("LeaveGroup() = %v", err)
+	}
+}
+
+func TestMulticastUDPReadable(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+
+	conn, err := iface.MulticastUDP(net.ParseIP("224.0.0.251"), 5353)
+
+	if err != nil {
+		t.Fatalf("MulticastUDP() = %v", err)
+	}
+
+	defer conn.Endpoint.Close()
+
+	if err := conn.SetMulticastLoop(true); err != nil {
+		t.Errorf("SetMulticastLoop() = %v", err)
+	}
+
+	if err := conn.SetMulticastTTL(4); err != nil {
+		t.Errorf("SetMulticastTTL() = %v", err)
+	}
+
+	ch, stop := conn.Readable()
+	defer stop()
+
+	select {
+	case <-ch:
+		t.Error("expected no readable event without a pending datagram")
+	default:
+	}
+}
@@ -15,15 +15,19 @@ package gnet
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"net"
 	"strconv"
+	"sync/atomic"
 
 	"gvisor.dev/gvisor/pkg/tcpip"
 	"gvisor.dev/gvisor/pkg/tcpip/header"
 	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
 	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/igmp"
 	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv6"
 	"gvisor.dev/gvisor/pkg/tcpip/stack"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/icmp"
 	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
@@ -38,14 +42,29 @@ var (
 	// NICID represents the default gVisor NIC identifier
 	NICID = tcpip.NICID(1)
 
-	// DefaultStackOptions represents the default gVisor Stack configuration
+	// ipv4Protocol is the IPv4 network protocol factory, with IGMP
+	// enabled so that multicast group membership (see Interface.JoinGroup)
+	// is advertised and maintained on the wire.
+	ipv4Protocol = ipv4.NewProtocolWithOptions(ipv4.Options{
+		IGMP: ipv4.IGMPOptions{Enabled: true},
+	})
+
+	// DefaultStackOptions represents the default gVisor Stack configuration.
+	//
+	// Both IPv4 and IPv6 network protocols are registered, allowing
+	// Interface.Init to configure dual-stack operation. IPv6 neighbor
+	// discovery is handled by gVisor's NDP implementation, ARP and IGMP
+	// are only relevant to the IPv4 family.
 	DefaultStackOptions = stack.Options{
 		NetworkProtocols: []stack.NetworkProtocolFactory{
-			ipv4.NewProtocol,
-			arp.NewProtocol},
+			ipv4Protocol,
+			ipv6.NewProtocol,
+			arp.NewProtocol,
+			igmp.NewProtocol},
 		TransportProtocols: []stack.TransportProtocolFactory{
 			tcp.NewProtocol,
 			icmp.NewProtocol4,
+			icmp.NewProtocol6,
 			udp.NewProtocol},
 	}
 )
@@ -57,82 +76,249 @@ type Interface struct {
 
 	Stack *stack.Stack
 	Link  *channel.Endpoint
+
+	// Lease holds the most recently acquired DHCPv4 lease, it is only set
+	// when the interface is configured through InitDHCP. It is updated
+	// from a background goroutine as the lease is renewed, use Load to
+	// read it concurrently.
+	Lease atomic.Pointer[Lease]
+
+	// tap mirrors RX/TX traffic flowing through Link to any consumer
+	// registered through Sniffer.
+	tap *tap
+
+	// middleware holds the link-layer decorators installed through Use,
+	// applied in order around Link at NIC creation time.
+	middleware []LinkMiddleware
+}
+
+// LinkMiddleware wraps a [stack.LinkEndpoint] to observe or transform the
+// frames flowing through it, see Interface.Use.
+type LinkMiddleware interface {
+	Wrap(stack.LinkEndpoint) stack.LinkEndpoint
+}
+
+// Use installs mw, in order, around the interface link endpoint. It must be
+// called before Init or InitDHCP, as the chain is assembled once at NIC
+// creation time: mw[0] wraps the raw link, mw[len(mw)-1] is the closest to
+// the stack.
+func (iface *Interface) Use(mw ...LinkMiddleware) {
+	iface.middleware = append(iface.middleware, mw...)
+}
+
+// nextNICID returns the package default NICID when s is nil (the common
+// case of a fresh, dedicated Stack), or the lowest NICID greater than or
+// equal to it that is neither already registered on s nor listed in
+// reserved otherwise. This allows a single Stack to be shared across
+// multiple Interfaces (or a Bridge and its members, see Bridge.allocateNICID),
+// each acquiring its own NICID, without callers having to assign one
+// manually. reserved covers NICIDs that have been handed out but not yet
+// registered on s, which NICInfo alone would not reflect.
+func nextNICID(s *stack.Stack, reserved ...tcpip.NICID) tcpip.NICID {
+	if s == nil {
+		return NICID
+	}
+
+	used := s.NICInfo()
+
+	isReserved := func(id tcpip.NICID) bool {
+		for _, r := range reserved {
+			if r == id {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	for id := NICID; ; id++ {
+		if _, ok := used[id]; !ok && !isReserved(id) {
+			return id
+		}
+	}
+}
+
+// normalizeIP returns ip in its shortest representation, 4 bytes for IPv4
+// addresses and 16 bytes for IPv6 ones, as expected by tcpip.AddrFromSlice.
+func normalizeIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+
+	return ip.To16()
 }
 
-func (iface *Interface) configure(mac string, ip tcpip.AddressWithPrefix, gw tcpip.Address) (err error) {
+// randomMAC returns a randomly generated MAC address, flagged as unicast and
+// locally administered, for use as a default when Init, InitDHCP or
+// NewBridge are not given an explicit one.
+func randomMAC() net.HardwareAddr {
+	laddr := make(net.HardwareAddr, 6)
+	rand.Read(laddr)
+	laddr[0] &= 0xfe
+	laddr[0] |= 0x02
+
+	return laddr
+}
+
+func (iface *Interface) configure(mac string, ips []tcpip.AddressWithPrefix, gateways []tcpip.Address) (err error) {
+	if err = iface.createNIC(mac); err != nil {
+		return
+	}
+
+	return iface.addAddresses(ips, gateways)
+}
+
+// createNIC allocates the gVisor Stack, if not previously assigned, and
+// registers the interface link endpoint as its NIC, it is a no-op if the
+// link has already been created (e.g. by a previous call or by InitDHCP).
+func (iface *Interface) createNIC(mac string) error {
 	if iface.Stack == nil {
 		iface.Stack = stack.New(DefaultStackOptions)
 	}
 
+	if iface.Link != nil {
+		return nil
+	}
+
 	linkAddr, err := tcpip.ParseMACAddress(mac)
 
 	if err != nil {
-		return
+		return err
 	}
 
 	iface.Link = channel.New(256, MTU, linkAddr)
 	iface.Link.LinkEPCapabilities |= stack.CapabilityResolutionRequired
+	iface.tap = &tap{own: linkAddr}
+
+	var linkEP stack.LinkEndpoint = &tapEndpoint{Endpoint: iface.Link, tap: iface.tap}
 
-	linkEP := stack.LinkEndpoint(iface.Link)
+	for _, mw := range iface.middleware {
+		linkEP = mw.Wrap(linkEP)
+	}
 
 	if err := iface.Stack.CreateNIC(iface.NICID, linkEP); err != nil {
 		return fmt.Errorf("%v", err)
 	}
 
-	protocolAddr := tcpip.ProtocolAddress{
-		Protocol:          ipv4.ProtocolNumber,
-		AddressWithPrefix: ip,
-	}
+	return nil
+}
 
-	if err := iface.Stack.AddProtocolAddress(iface.NICID, protocolAddr, stack.AddressProperties{}); err != nil {
-		return fmt.Errorf("%v", err)
+// addAddresses adds the given addresses and default gateways to the
+// interface NIC, which must have already been created via createNIC. Adding
+// an address already assigned to the NIC (e.g. a DHCP lease renewed with the
+// same IP) is a no-op, as is adding a route already present in the route
+// table, so repeated calls for the same ip/gateway are safe.
+func (iface *Interface) addAddresses(ips []tcpip.AddressWithPrefix, gateways []tcpip.Address) (err error) {
+	rt := iface.Stack.GetRouteTable()
+
+	for _, ip := range ips {
+		protocolNumber := ipv4.ProtocolNumber
+
+		if ip.Address.Len() == header.IPv6AddressSize {
+			protocolNumber = ipv6.ProtocolNumber
+		}
+
+		protocolAddr := tcpip.ProtocolAddress{
+			Protocol:          protocolNumber,
+			AddressWithPrefix: ip,
+		}
+
+		if nicID := iface.Stack.CheckLocalAddress(iface.NICID, protocolNumber, ip.Address); nicID == 0 {
+			if err := iface.Stack.AddProtocolAddress(iface.NICID, protocolAddr, stack.AddressProperties{}); err != nil {
+				return fmt.Errorf("%v", err)
+			}
+		}
+
+		subnet := protocolAddr.AddressWithPrefix.Subnet()
+		haveRoute := false
+
+		for _, r := range rt {
+			if r.Destination == subnet && r.NIC == iface.NICID {
+				haveRoute = true
+				break
+			}
+		}
+
+		if !haveRoute {
+			rt = append(rt, tcpip.Route{
+				Destination: subnet,
+				NIC:         iface.NICID,
+			})
+		}
 	}
 
-	rt := iface.Stack.GetRouteTable()
+	for _, gw := range gateways {
+		dst := header.IPv4EmptySubnet
 
-	rt = append(rt, tcpip.Route{
-		Destination: protocolAddr.AddressWithPrefix.Subnet(),
-		NIC:         iface.NICID,
-	})
+		if gw.Len() == header.IPv6AddressSize {
+			dst = header.IPv6EmptySubnet
+		}
 
-	rt = append(rt, tcpip.Route{
-		Destination: header.IPv4EmptySubnet,
-		Gateway:     gw,
-		NIC:         iface.NICID,
-	})
+		haveRoute := false
+
+		for _, r := range rt {
+			if r.Destination == dst && r.Gateway == gw && r.NIC == iface.NICID {
+				haveRoute = true
+				break
+			}
+		}
+
+		if !haveRoute {
+			rt = append(rt, tcpip.Route{
+				Destination: dst,
+				Gateway:     gw,
+				NIC:         iface.NICID,
+			})
+		}
+	}
 
 	iface.Stack.SetRouteTable(rt)
 
 	return
 }
 
-// EnableICMP adds an ICMP endpoint to the interface, it is useful to enable
-// ping requests.
+// EnableICMP adds ICMP endpoints to the interface, it is useful to enable
+// ping requests. Both IPv4 and IPv6 endpoints are bound, each only if the
+// corresponding address family is configured on the interface.
 func (iface *Interface) EnableICMP() error {
-	var wq waiter.Queue
+	if err := iface.enableICMP(ipv4.ProtocolNumber, icmp.ProtocolNumber4); err != nil {
+		return err
+	}
+
+	if err := iface.enableICMP(ipv6.ProtocolNumber, icmp.ProtocolNumber6); err != nil {
+		return err
+	}
+
+	return nil
+}
 
-	ep, err := iface.Stack.NewEndpoint(icmp.ProtocolNumber4, ipv4.ProtocolNumber, &wq)
+func (iface *Interface) enableICMP(netProto tcpip.NetworkProtocolNumber, transProto tcpip.TransportProtocolNumber) error {
+	addr, tcpErr := iface.Stack.GetMainNICAddress(iface.NICID, netProto)
 
-	if err != nil {
-		return fmt.Errorf("endpoint error (icmp): %v", err)
+	if tcpErr != nil || addr.Address.Len() == 0 {
+		// address family not configured on this interface
+		return nil
 	}
 
-	addr, tcpErr := iface.Stack.GetMainNICAddress(iface.NICID, ipv4.ProtocolNumber)
+	var wq waiter.Queue
+
+	ep, err := iface.Stack.NewEndpoint(transProto, netProto, &wq)
 
-	if tcpErr != nil {
-		return fmt.Errorf("couldn't get NIC IP address: %v", tcpErr)
+	if err != nil {
+		return fmt.Errorf("endpoint error (icmp): %v", err)
 	}
 
 	fullAddr := tcpip.FullAddress{Addr: addr.Address, Port: 0, NIC: iface.NICID}
 
 	if err := ep.Bind(fullAddr); err != nil {
-		return fmt.Errorf("bind error (icmp endpoint): ", err)
+		return fmt.Errorf("bind error (icmp endpoint): %v", err)
 	}
 
 	return nil
 }
 
-// fullAddr attempts to convert the ip:port to a FullAddress struct.
+// fullAddr attempts to convert the ip:port to a FullAddress struct, it
+// supports both IPv4 and IPv6 addresses.
 func fullAddr(a string) (tcpip.FullAddress, error) {
 	var p int
 
@@ -147,27 +333,57 @@ func fullAddr(a string) (tcpip.FullAddress, error) {
 	}
 
 	addr := net.ParseIP(host)
-	return tcpip.FullAddress{Addr: tcpip.AddrFromSlice(addr.To4()), Port: uint16(p)}, nil
+
+	if addr == nil {
+		return tcpip.FullAddress{}, fmt.Errorf("invalid IP address %q", host)
+	}
+
+	return tcpip.FullAddress{Addr: tcpip.AddrFromSlice(normalizeIP(addr)), Port: uint16(p)}, nil
 }
 
 // Init initializes a [NetworkDevice] associating it to a gVisor link, a
 // default NICID and TCP/IP gVisor Stack are set if not previously assigned, a
 // random MAC address is set if its argument is empty.
-func (iface *Interface) Init(nic NetworkDevice, addr string, mac string, gateway string) (err error) {
+//
+// One or more addresses can be passed in addrs, each in CIDR notation,
+// allowing dual-stack (IPv4 and IPv6) configuration, with a matching default
+// gateway, if any, for each configured family passed in gateways.
+func (iface *Interface) Init(nic NetworkDevice, addrs []string, mac string, gateways []string) (err error) {
 	var laddr net.HardwareAddr
 
-	ip, ipnet, err := net.ParseCIDR(addr)
+	if len(addrs) == 0 {
+		return errors.New("at least one address is required")
+	}
+
+	ips := make([]tcpip.AddressWithPrefix, 0, len(addrs))
 
-	if err != nil {
-		return
+	for _, addr := range addrs {
+		ip, ipnet, err := net.ParseCIDR(addr)
+
+		if err != nil {
+			return err
+		}
+
+		ips = append(ips, tcpip.AddressWithPrefix{
+			Address:   tcpip.AddrFromSlice(normalizeIP(ip)),
+			PrefixLen: tcpip.MaskFromBytes(ipnet.Mask).Prefix(),
+		})
+	}
+
+	gws := make([]tcpip.Address, 0, len(gateways))
+
+	for _, gateway := range gateways {
+		gwIP := net.ParseIP(gateway)
+
+		if gwIP == nil {
+			return fmt.Errorf("invalid gateway address %q", gateway)
+		}
+
+		gws = append(gws, tcpip.AddrFromSlice(normalizeIP(gwIP)))
 	}
 
 	if len(mac) == 0 {
-		laddr = make([]byte, 6)
-		rand.Read(laddr)
-		// flag address as unicast and locally administered
-		laddr[0] &= 0xfe
-		laddr[0] |= 0x02
+		laddr = randomMAC()
 	} else {
 		if laddr, err = net.ParseMAC(mac); err != nil {
 			return
@@ -175,17 +391,10 @@ func (iface *Interface) Init(nic NetworkDevice, addr string, mac string, gateway
 	}
 
 	if iface.NICID == 0 {
-		iface.NICID = NICID
+		iface.NICID = nextNICID(iface.Stack)
 	}
 
-	ipAddr := tcpip.AddressWithPrefix{
-		Address:   tcpip.AddrFromSlice(ip.To4()),
-		PrefixLen: tcpip.MaskFromBytes(ipnet.Mask).Prefix(),
-	}
-
-	gwAddr := tcpip.AddrFromSlice(net.ParseIP(gateway)).To4()
-
-	if err = iface.configure(laddr.String(), ipAddr, gwAddr); err != nil {
+	if err = iface.configure(laddr.String(), ips, gws); err != nil {
 		return
 	}
 
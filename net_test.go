@@ -0,0 +1,59 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"net"
+	"testing"
+)
+
+func TestNormalizeIP(t *testing.T) {
+	if got := normalizeIP(net.ParseIP("192.168.1.1")); len(got) != net.IPv4len {
+		t.Errorf("normalizeIP(IPv4) = %d bytes, want %d", len(got), net.IPv4len)
+	}
+
+	if got := normalizeIP(net.ParseIP("2001:db8::1")); len(got) != net.IPv6len {
+		t.Errorf("normalizeIP(IPv6) = %d bytes, want %d", len(got), net.IPv6len)
+	}
+}
+
+func TestFullAddr(t *testing.T) {
+	addr, err := fullAddr("192.168.1.1:53")
+
+	if err != nil {
+		t.Fatalf("fullAddr() = %v", err)
+	}
+
+	if addr.Port != 53 || addr.Addr.Len() != net.IPv4len {
+		t.Errorf("fullAddr() = %+v, want IPv4 address on port 53", addr)
+	}
+
+	addr, err = fullAddr("[2001:db8::1]:53")
+
+	if err != nil {
+		t.Fatalf("fullAddr() = %v", err)
+	}
+
+	if addr.Port != 53 || addr.Addr.Len() != net.IPv6len {
+		t.Errorf("fullAddr() = %+v, want IPv6 address on port 53", addr)
+	}
+
+	addr, err = fullAddr("192.168.1.1")
+
+	if err != nil {
+		t.Fatalf("fullAddr() = %v", err)
+	}
+
+	if addr.Port != 0 {
+		t.Errorf("fullAddr() without a port = %+v, want port 0", addr)
+	}
+}
+
+func TestFullAddrRejectsInvalidHost(t *testing.T) {
+	if _, err := fullAddr("not-an-ip:53"); err == nil {
+		t.Error("fullAddr() on an invalid host = nil error, want one")
+	}
+}
@@ -0,0 +1,322 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+)
+
+// Direction identifies whether a captured [Frame] was received from, or
+// transmitted to, the Ethernet link.
+type Direction int
+
+const (
+	// RX identifies frames received from the link.
+	RX Direction = iota
+	// TX identifies frames transmitted to the link.
+	TX
+)
+
+// Frame represents a single captured raw Ethernet frame, as handed to, or
+// received from, iface.Link. Packets handed to iface.Link carry no Ethernet
+// header of their own, so for TX one is built from the link addresses the
+// stack resolved for the packet.
+type Frame struct {
+	Timestamp time.Time
+	Direction Direction
+	Data      []byte
+}
+
+// tapFilter narrows which frames a registered sniffer sink observes, see
+// Interface.Sniffer.
+type tapFilter struct {
+	etherTypes  map[tcpip.NetworkProtocolNumber]struct{}
+	promiscuous bool
+}
+
+// allow reports whether protocol passes the ethertype restriction, an empty
+// etherTypes set allows every protocol.
+func (f *tapFilter) allow(protocol tcpip.NetworkProtocolNumber) bool {
+	if len(f.etherTypes) == 0 {
+		return true
+	}
+
+	_, ok := f.etherTypes[protocol]
+
+	return ok
+}
+
+type tapSink struct {
+	ch     chan Frame
+	filter tapFilter
+}
+
+// tap fans out copies of the frames flowing through an interface link to any
+// number of registered sniffer channels, without ever blocking the data
+// path: a consumer that falls behind misses frames rather than stalling RX/TX.
+type tap struct {
+	mu     sync.Mutex
+	sinks  []tapSink
+	active atomic.Bool
+
+	// own is the interface's own link address, used to filter out frames
+	// addressed elsewhere for a non-promiscuous sink.
+	own tcpip.LinkAddress
+}
+
+// isGroupAddress reports whether addr is a broadcast or multicast Ethernet
+// address (the group bit of its first octet set).
+func isGroupAddress(addr tcpip.LinkAddress) bool {
+	return len(addr) > 0 && addr[0]&0x01 != 0
+}
+
+// capture fans data out to every registered sink whose filter matches,
+// active must have already been checked by the caller so that no frame is
+// ever flattened off the data path when no sniffer is attached. dst is only
+// meaningful, and only enforced, for RX: a TX frame is always the
+// interface's own and reaches every sink whose ethertype filter admits it,
+// whether or not the sink is promiscuous.
+func (t *tap) capture(dir Direction, protocol tcpip.NetworkProtocolNumber, dst tcpip.LinkAddress, data []byte) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if len(t.sinks) == 0 {
+		return
+	}
+
+	frame := Frame{
+		Timestamp: time.Now(),
+		Direction: dir,
+		Data:      append([]byte(nil), data...),
+	}
+
+	for _, sink := range t.sinks {
+		if !sink.filter.allow(protocol) {
+			continue
+		}
+
+		if dir == RX && !sink.filter.promiscuous && len(dst) != 0 && len(t.own) != 0 && dst != t.own && !isGroupAddress(dst) {
+			continue
+		}
+
+		select {
+		case sink.ch <- frame:
+		default:
+		}
+	}
+}
+
+func (t *tap) attach(filter tapFilter) chan Frame {
+	ch := make(chan Frame, 256)
+
+	t.mu.Lock()
+	t.sinks = append(t.sinks, tapSink{ch: ch, filter: filter})
+	t.active.Store(true)
+	t.mu.Unlock()
+
+	return ch
+}
+
+func (t *tap) detach(ch chan Frame) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for i, sink := range t.sinks {
+		if sink.ch == ch {
+			t.sinks = append(t.sinks[:i], t.sinks[i+1:]...)
+			t.active.Store(len(t.sinks) != 0)
+			close(ch)
+			return
+		}
+	}
+}
+
+// tapEndpoint wraps a [channel.Endpoint] to mirror every frame it delivers
+// inbound (RX, via Attach/DeliverNetworkPacket) or accepts outbound (TX, via
+// WritePackets) to its tap, without altering normal stack delivery.
+type tapEndpoint struct {
+	*channel.Endpoint
+	tap *tap
+}
+
+func (e *tapEndpoint) Attach(dispatcher stack.NetworkDispatcher) {
+	e.Endpoint.Attach(&tapDispatcher{NetworkDispatcher: dispatcher, tap: e.tap})
+}
+
+func (e *tapEndpoint) WritePackets(pkts stack.PacketBufferList) (int, tcpip.Error) {
+	if e.tap.active.Load() {
+		for _, pkt := range pkts.AsSlice() {
+			src := pkt.EgressRoute.LocalLinkAddress
+
+			if len(src) == 0 {
+				src = e.Endpoint.LinkAddress()
+			}
+
+			frame := make([]byte, header.EthernetMinimumSize)
+			header.Ethernet(frame).Encode(&header.EthernetFields{
+				SrcAddr: src,
+				DstAddr: pkt.EgressRoute.RemoteLinkAddress,
+				Type:    pkt.NetworkProtocolNumber,
+			})
+
+			e.tap.capture(TX, pkt.NetworkProtocolNumber, "", append(frame, pkt.ToBuffer().Flatten()...))
+		}
+	}
+
+	return e.Endpoint.WritePackets(pkts)
+}
+
+// tapDispatcher wraps a [stack.NetworkDispatcher] to mirror every packet
+// delivered to it before forwarding it unchanged.
+type tapDispatcher struct {
+	stack.NetworkDispatcher
+	tap *tap
+}
+
+func (d *tapDispatcher) DeliverNetworkPacket(protocol tcpip.NetworkProtocolNumber, pkt *stack.PacketBuffer) {
+	if d.tap.active.Load() {
+		var dst tcpip.LinkAddress
+
+		if hdr := pkt.LinkHeader().Slice(); len(hdr) >= header.EthernetMinimumSize {
+			dst = header.Ethernet(hdr).DestinationAddress()
+		}
+
+		d.tap.capture(RX, protocol, dst, pkt.ToBuffer().Flatten())
+	}
+
+	d.NetworkDispatcher.DeliverNetworkPacket(protocol, pkt)
+}
+
+// SnifferOptions restricts the scope of an Interface.Sniffer capture.
+type SnifferOptions struct {
+	// EtherTypes restricts capture to the given link-layer protocols
+	// (e.g. header.IPv4ProtocolNumber, header.ARPProtocolNumber), every
+	// protocol is captured when empty.
+	EtherTypes []tcpip.NetworkProtocolNumber
+	// Promiscuous captures every frame flowing through the link,
+	// including those addressed to a MAC other than the interface's own,
+	// mirroring hardware promiscuous mode. It only matters when frames
+	// other than the interface's own reach the link, e.g. as a member of
+	// a Bridge; by default those are filtered out.
+	Promiscuous bool
+}
+
+// Sniffer starts capturing raw Ethernet frames flowing through the
+// interface link, including VLAN tagged, ARP and any other non-IP traffic
+// that the typed stack endpoints cannot otherwise observe. opts may be nil
+// to capture every protocol addressed to the interface.
+//
+// It returns a channel of captured frames and a function that stops the
+// capture and releases the channel. The channel must be drained promptly,
+// frames are dropped rather than queued once its buffer fills.
+func (iface *Interface) Sniffer(opts *SnifferOptions) (<-chan Frame, func()) {
+	var filter tapFilter
+
+	if opts != nil {
+		filter.promiscuous = opts.Promiscuous
+
+		if len(opts.EtherTypes) != 0 {
+			filter.etherTypes = make(map[tcpip.NetworkProtocolNumber]struct{}, len(opts.EtherTypes))
+
+			for _, p := range opts.EtherTypes {
+				filter.etherTypes[p] = struct{}{}
+			}
+		}
+	}
+
+	ch := iface.tap.attach(filter)
+
+	return ch, func() {
+		iface.tap.detach(ch)
+	}
+}
+
+// Inject delivers a raw Ethernet frame to the interface as if it had just
+// been received on the wire.
+func (iface *Interface) Inject(frame []byte) error {
+	if len(frame) < header.EthernetMinimumSize {
+		return errors.New("gnet: short Ethernet frame")
+	}
+
+	pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+		Payload: buffer.MakeWithData(append([]byte(nil), frame...)),
+	})
+	defer pkt.DecRef()
+
+	// Consume, rather than discard, the Ethernet header: it stays attached
+	// to pkt as its link header, so that tapDispatcher and any bridge this
+	// interface is a member of see the same frame a sniffer would, instead
+	// of only the network-layer payload InjectInbound dispatches on.
+	hdr, ok := pkt.LinkHeader().Consume(header.EthernetMinimumSize)
+
+	if !ok {
+		return errors.New("gnet: short Ethernet frame")
+	}
+
+	iface.Link.InjectInbound(header.Ethernet(hdr).Type(), pkt)
+
+	return nil
+}
+
+// pcap file format constants, see https://wiki.wireshark.org/Development/LibpcapFileFormat.
+const (
+	pcapMagic            = 0xa1b2c3d4
+	pcapVersionMajor     = 2
+	pcapVersionMinor     = 4
+	pcapLinkTypeEthernet = 1
+)
+
+// PCAPWriter serializes captured [Frame]s to a standard libpcap file,
+// readable by tools such as tcpdump and Wireshark, for offline analysis.
+type PCAPWriter struct {
+	w io.Writer
+}
+
+// NewPCAPWriter writes a libpcap global header to w and returns a
+// PCAPWriter ready to append frames to it.
+func NewPCAPWriter(w io.Writer) (*PCAPWriter, error) {
+	hdr := make([]byte, 24)
+	binary.LittleEndian.PutUint32(hdr[0:4], pcapMagic)
+	binary.LittleEndian.PutUint16(hdr[4:6], pcapVersionMajor)
+	binary.LittleEndian.PutUint16(hdr[6:8], pcapVersionMinor)
+	binary.LittleEndian.PutUint32(hdr[16:20], MTU)
+	binary.LittleEndian.PutUint32(hdr[20:24], pcapLinkTypeEthernet)
+
+	if _, err := w.Write(hdr); err != nil {
+		return nil, err
+	}
+
+	return &PCAPWriter{w: w}, nil
+}
+
+// WriteFrame appends a captured frame as a pcap record.
+func (p *PCAPWriter) WriteFrame(f Frame) error {
+	rec := make([]byte, 16)
+
+	binary.LittleEndian.PutUint32(rec[0:4], uint32(f.Timestamp.Unix()))
+	binary.LittleEndian.PutUint32(rec[4:8], uint32(f.Timestamp.Nanosecond()/1e3))
+	binary.LittleEndian.PutUint32(rec[8:12], uint32(len(f.Data)))
+	binary.LittleEndian.PutUint32(rec[12:16], uint32(len(f.Data)))
+
+	if _, err := p.w.Write(rec); err != nil {
+		return err
+	}
+
+	_, err := p.w.Write(f.Data)
+
+	return err
+}
@@ -0,0 +1,149 @@
+// Copyright (c) The go-net authors. All Rights Reserved.
+//
+// Use of this source code is governed by the license
+// that can be found in the LICENSE file.
+
+package gnet
+
+import (
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/arp"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+func newTestSniffedInterface(t *testing.T) *Interface {
+	t.Helper()
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol, arp.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{udp.NewProtocol},
+	})
+
+	iface := &Interface{Stack: s, NICID: 1}
+
+	if err := iface.createNIC("02:00:00:00:00:01"); err != nil {
+		t.Fatalf("createNIC() = %v", err)
+	}
+
+	return iface
+}
+
+func buildEthernet(t *testing.T, src, dst tcpip.LinkAddress, proto tcpip.NetworkProtocolNumber, payload []byte) []byte {
+	t.Helper()
+
+	frame := make([]byte, header.EthernetMinimumSize+len(payload))
+
+	header.Ethernet(frame).Encode(&header.EthernetFields{
+		SrcAddr: src,
+		DstAddr: dst,
+		Type:    proto,
+	})
+	copy(frame[header.EthernetMinimumSize:], payload)
+
+	return frame
+}
+
+func recvFrame(t *testing.T, ch <-chan Frame) (Frame, bool) {
+	t.Helper()
+
+	select {
+	case f := <-ch:
+		return f, true
+	case <-time.After(100 * time.Millisecond):
+		return Frame{}, false
+	}
+}
+
+func TestInjectCapturesTheFullOriginalFrame(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+	ch, stop := iface.Sniffer(nil)
+	defer stop()
+
+	frame := buildEthernet(t, "\x02\x00\x00\x00\x00\x02", iface.Link.LinkAddress(), ipv4.ProtocolNumber, make([]byte, 20))
+
+	if err := iface.Inject(frame); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	got, ok := recvFrame(t, ch)
+
+	if !ok {
+		t.Fatal("expected a captured frame, got none")
+	}
+
+	if string(got.Data) != string(frame) {
+		t.Errorf("captured frame = %x, want %x", got.Data, frame)
+	}
+
+	if _, ok := recvFrame(t, ch); ok {
+		t.Error("expected a single capture per injection, got a second one")
+	}
+}
+
+func TestSnifferEtherTypeFilter(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+
+	ch, stop := iface.Sniffer(&SnifferOptions{EtherTypes: []tcpip.NetworkProtocolNumber{arp.ProtocolNumber}})
+	defer stop()
+
+	frame := buildEthernet(t, "\x02\x00\x00\x00\x00\x02", iface.Link.LinkAddress(), ipv4.ProtocolNumber, make([]byte, 20))
+
+	if err := iface.Inject(frame); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	if _, ok := recvFrame(t, ch); ok {
+		t.Error("expected the IPv4 frame to be filtered out by an ARP-only EtherTypes filter")
+	}
+}
+
+func TestSnifferFiltersForeignDestinationUnlessPromiscuous(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+
+	foreign := buildEthernet(t, "\x02\x00\x00\x00\x00\x02", "\x02\x00\x00\x00\x00\x03", ipv4.ProtocolNumber, make([]byte, 20))
+
+	ch, stop := iface.Sniffer(nil)
+
+	if err := iface.Inject(foreign); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	if _, ok := recvFrame(t, ch); ok {
+		t.Error("expected a frame addressed to another MAC to be filtered out by default")
+	}
+
+	stop()
+
+	ch, stop = iface.Sniffer(&SnifferOptions{Promiscuous: true})
+	defer stop()
+
+	if err := iface.Inject(foreign); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	if _, ok := recvFrame(t, ch); !ok {
+		t.Error("expected a promiscuous sniffer to observe a frame addressed to another MAC")
+	}
+}
+
+func TestSnifferAlwaysCapturesBroadcast(t *testing.T) {
+	iface := newTestSniffedInterface(t)
+	ch, stop := iface.Sniffer(nil)
+	defer stop()
+
+	frame := buildEthernet(t, "\x02\x00\x00\x00\x00\x02", header.EthernetBroadcastAddress, arp.ProtocolNumber, make([]byte, 20))
+
+	if err := iface.Inject(frame); err != nil {
+		t.Fatalf("Inject() = %v", err)
+	}
+
+	if _, ok := recvFrame(t, ch); !ok {
+		t.Error("expected a non-promiscuous sniffer to still observe a broadcast frame")
+	}
+}